@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/nats-io/nats.go"
+)
+
+type eventType string
+
+const (
+	eventEnqueued       eventType = "task.enqueued"
+	eventStarted        eventType = "task.started"
+	eventSucceeded      eventType = "task.succeeded"
+	eventFailed         eventType = "task.failed"
+	eventRetryScheduled eventType = "task.retry_scheduled"
+	eventDead           eventType = "task.dead"
+	eventRescheduled    eventType = "task.rescheduled"
+)
+
+// taskEvent describes a single step in a task's lifecycle, published to the
+// configured EventSink so operators can watch delivery and dead-lettering
+// without polling /waiting, /success or /dead.
+type taskEvent struct {
+	Type       eventType     `json:"type"`
+	Time       int64         `json:"time"`
+	TaskID     string        `json:"task_id"`
+	URL        string        `json:"url"`
+	Tries      int           `json:"tries"`
+	NextRun    int64         `json:"next_run,omitempty"`
+	LastStatus int           `json:"last_status,omitempty"`
+	ReqID      string        `json:"req_id,omitempty"`
+	Duration   time.Duration `json:"duration,omitempty"`
+}
+
+// EventSink publishes task lifecycle events. Publish must never block the
+// worker goroutine calling it and a publish failure must never be treated as
+// a task failure, so implementations log and swallow their own errors.
+type EventSink interface {
+	Publish(ev *taskEvent)
+}
+
+func publishEvent(ev *taskEvent) {
+	ev.Time = time.Now().UnixNano()
+	eventSink.Publish(ev)
+	if js, err := json.Marshal(ev); err == nil {
+		eventsHub.broadcast(ev.TaskID, js)
+	}
+}
+
+// stdoutSink is the default sink and preserves the original log-line
+// behavior of the task lifecycle.
+type stdoutSink struct{}
+
+func (stdoutSink) Publish(ev *taskEvent) {
+	log.Printf("event=%s task_id=%s url=%s tries=%d last_status=%d req_id=%s duration=%v\n",
+		ev.Type, ev.TaskID, ev.URL, ev.Tries, ev.LastStatus, ev.ReqID, ev.Duration)
+}
+
+// webhookSink posts every event as JSON to a configured URL.
+type webhookSink struct {
+	url string
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url}
+}
+
+func (s *webhookSink) Publish(ev *taskEvent) {
+	js, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("eventsink: webhook: failed to marshal event: %v\n", err)
+		return
+	}
+	// Don't let a slow or unreachable receiver hold up the worker.
+	go func() {
+		resp, err := http.Post(s.url, "application/json", bytes.NewReader(js))
+		if err != nil {
+			log.Printf("eventsink: webhook: publish failed: %v\n", err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// natsSink publishes events on a NATS subject.
+type natsSink struct {
+	nc      *nats.Conn
+	subject string
+}
+
+func newNATSSink(url, subject string) (*natsSink, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &natsSink{nc: nc, subject: subject}, nil
+}
+
+func (s *natsSink) Publish(ev *taskEvent) {
+	js, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("eventsink: nats: failed to marshal event: %v\n", err)
+		return
+	}
+	if err := s.nc.Publish(s.subject, js); err != nil {
+		log.Printf("eventsink: nats: publish failed: %v\n", err)
+	}
+}
+
+// kafkaSink publishes events on a Kafka topic via an async producer so
+// publishing never blocks the caller on broker round-trips.
+type kafkaSink struct {
+	producer sarama.AsyncProducer
+	topic    string
+}
+
+func newKafkaSink(brokers, topic string) (*kafkaSink, error) {
+	cfg := sarama.NewConfig()
+	cfg.Producer.Return.Successes = false
+	producer, err := sarama.NewAsyncProducer(strings.Split(brokers, ","), cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for err := range producer.Errors() {
+			log.Printf("eventsink: kafka: publish failed: %v\n", err)
+		}
+	}()
+	return &kafkaSink{producer: producer, topic: topic}, nil
+}
+
+func (s *kafkaSink) Publish(ev *taskEvent) {
+	js, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("eventsink: kafka: failed to marshal event: %v\n", err)
+		return
+	}
+	// Input() has a bounded buffer (ChannelBufferSize); if the broker is
+	// unreachable or slow long enough to fill it, a direct send blocks the
+	// calling worker. Send from a goroutine like webhookSink does so a
+	// backed-up producer only delays its own event, never the worker.
+	go func() {
+		s.producer.Input() <- &sarama.ProducerMessage{
+			Topic: s.topic,
+			Key:   sarama.StringEncoder(ev.TaskID),
+			Value: sarama.ByteEncoder(js),
+		}
+	}()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/json"
@@ -16,25 +17,33 @@ import (
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/robfig/cron"
-	"golang.org/x/time/rate"
 )
 
 var (
-	authKey  = os.Getenv("POUSSETACHES_AUTH_KEY")
-	basePath = "poussetaches_data"
-	client   = &http.Client{}
-	wg       = sync.WaitGroup{}
-	tasksMu  = sync.Mutex{}
-	tasks    = []*task{}
-	paused   = true
-	inFlight = 0
-	limiter  *rate.Limiter
-	schedIdx = map[string]struct{}{}
+	authKey        = os.Getenv("POUSSETACHES_AUTH_KEY")
+	basePath       = "poussetaches_data"
+	client         = &http.Client{}
+	wg             = sync.WaitGroup{}
+	tasksMu        = sync.Mutex{}
+	paused         = true
+	inFlight       = 0
+	schedIdx       = map[string]struct{}{}
+	defaultTimeout = envInt("POUSSETACHES_DEFAULT_TIMEOUT", 30)
+	store          Store
+	eventSink      EventSink = stdoutSink{}
+
+	// Debug-only failure injection, for exercising retry/backoff and
+	// dead-lettering deterministically without a flaky upstream. Off unless
+	// explicitly enabled.
+	debugFailureInjection = os.Getenv("POUSSETACHES_DEBUG_FAILURE_INJECTION") == "1"
+	debugFailureRate      = envFloat("POUSSETACHES_DEBUG_FAILURE_RATE", 0)
+	debugFailureStatus    = envInt("POUSSETACHES_DEBUG_FAILURE_STATUS", 500)
 )
 
 const (
@@ -42,15 +51,92 @@ const (
 	maxRetries = 12
 )
 
-var retries = []int{
-	1, 4, 16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304,
+// envInt returns the int value of the given env var, or def if unset/invalid.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// envFloat returns the float64 value of the given env var, or def if
+// unset/invalid.
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// RetryPolicy controls how a task's retry delay grows after a failure:
+// BaseDelay * Multiplier^(attempt-1), capped at MaxDelay, randomized by
+// +/- JitterFraction, giving up after MaxAttempts tries.
+type RetryPolicy struct {
+	BaseDelay      int     `json:"base_delay,omitempty"`
+	Multiplier     float64 `json:"multiplier,omitempty"`
+	MaxDelay       int     `json:"max_delay,omitempty"`
+	MaxAttempts    int     `json:"max_attempts,omitempty"`
+	JitterFraction float64 `json:"jitter_fraction,omitempty"`
+}
+
+// defaultRetryPolicy reproduces the schedule poussetaches has always used:
+// 1s, 4s, 16s, ... (the last retry waits 4^10s, ~12 days), giving up after
+// 12 tries.
+var defaultRetryPolicy = RetryPolicy{
+	BaseDelay:      1,
+	Multiplier:     4,
+	MaxDelay:       4194304,
+	MaxAttempts:    maxRetries,
+	JitterFraction: 0.3,
+}
+
+// orDefault fills in any zero-valued field of p from defaultRetryPolicy,
+// field by field, so a submission that only overrides e.g. MaxAttempts
+// keeps the default BaseDelay/Multiplier/MaxDelay/JitterFraction instead of
+// having the whole policy reset.
+func (p RetryPolicy) orDefault() RetryPolicy {
+	if p.BaseDelay == 0 {
+		p.BaseDelay = defaultRetryPolicy.BaseDelay
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = defaultRetryPolicy.Multiplier
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultRetryPolicy.MaxDelay
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryPolicy.MaxAttempts
+	}
+	if p.JitterFraction == 0 {
+		p.JitterFraction = defaultRetryPolicy.JitterFraction
+	}
+	return p
 }
 
-// "randomize" the retries delay
-func addJitter(i int) int {
-	// add +/- 30% randomly
-	jitter := float64(mrand.Int63n(30)) / 100
-	if mrand.Int63n(1) == 0 {
+// delay returns the backoff, in seconds, after the given failed attempt
+// (1-indexed), i.e. before the next one.
+func (p RetryPolicy) delay(attempt int) int {
+	d := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	return int(d)
+}
+
+// "randomize" the retries delay by +/- fraction
+func addJitter(i int, fraction float64) int {
+	jitter := fraction * float64(mrand.Int63n(100)) / 100
+	if mrand.Intn(2) == 0 {
 		return int(math.Round((1.0 - jitter) * float64(i)))
 	}
 	return int(math.Round((1.0 + jitter) * float64(i)))
@@ -71,6 +157,18 @@ type newTaskInput struct {
 	Expected int    `json:"expected"`
 	Schedule string `json:"schedule,omitempty"`
 	Delay    int    `json:"delay,omitempty"`
+	Timeout  int    `json:"timeout,omitempty"`
+
+	RetryPolicy RetryPolicy `json:"retry_policy,omitempty"`
+
+	// SigningVersion opts into HMAC request signing. 0 (default) only sends
+	// the legacy Poussetaches-Auth-Key header, for receivers that haven't
+	// migrated yet.
+	SigningVersion int `json:"signing_version,omitempty"`
+
+	// RateLimitKey overrides which rate limiter bucket this task is queued
+	// under. Defaults to the destination URL's host.
+	RateLimitKey string `json:"rate_limit_key,omitempty"`
 }
 
 type task struct {
@@ -80,6 +178,11 @@ type task struct {
 	Payload  []byte `json:"payload"`
 	Expected int    `json:"expected"`
 	Schedule string `json:"schedule"`
+	Timeout  int    `json:"timeout,omitempty"`
+
+	RetryPolicy    RetryPolicy `json:"retry_policy,omitempty"`
+	SigningVersion int         `json:"signing_version,omitempty"`
+	RateLimitKey   string      `json:"rate_limit_key,omitempty"`
 
 	NextScheduledRun int64 `json:"next_scheduled_run"`
 	NextRun          int64 `json:"next_run"`
@@ -96,7 +199,7 @@ type taskPayload struct {
 	ReqID   string `json:"req_id"`
 }
 
-func (t *task) execute() error {
+func (t *task) execute(ctx context.Context) error {
 	tasksMu.Lock()
 	inFlight++
 	tasksMu.Unlock()
@@ -107,6 +210,7 @@ func (t *task) execute() error {
 	}()
 	t.Tries++
 	reqID := newID(6)
+	publishEvent(&taskEvent{Type: eventStarted, TaskID: t.ID, URL: t.URL, Tries: t.Tries, ReqID: reqID})
 	tp := &taskPayload{
 		Payload: t.Payload,
 		Tries:   t.Tries,
@@ -116,17 +220,47 @@ func (t *task) execute() error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", t.URL, bytes.NewBuffer(p))
+
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", t.URL, bytes.NewBuffer(p))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Poussetaches-Auth-Key", authKey)
-	log.Printf("req=%+v", req)
+	if t.SigningVersion >= 1 && signingSecret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Poussetaches-Signature", signRequest(signingSecret, ts, reqID, p))
+		req.Header.Set("Poussetaches-Timestamp", ts)
+		req.Header.Set("Poussetaches-Request-ID", reqID)
+	}
+	// Log method/URL only: req.Header carries Poussetaches-Auth-Key (and any
+	// signing headers), which must never hit the log in plaintext.
+	log.Printf("req method=%s url=%s\n", req.Method, req.URL)
 
+	if debugFailureInjection && mrand.Float64() < debugFailureRate {
+		log.Printf("debug: injecting failure status=%d for task %s\n", debugFailureStatus, t.ID)
+		return failure(t, reqID, debugFailureStatus, []byte("injected failure"))
+	}
+
+	reqStart := time.Now()
 	resp, err := client.Do(req)
+	latency := time.Since(reqStart)
 	if err != nil {
+		if reqCtx.Err() == context.Canceled {
+			// Shutdown is in progress, not a delivery failure: don't burn a retry.
+			t.Tries--
+			log.Printf("task execution aborted by shutdown: %+v\n", t)
+			return err
+		}
+		publishRequestLog(&requestLogEntry{TaskID: t.ID, ReqID: reqID, Status: -1, Latency: latency, Err: err.Error()})
 		log.Printf("req failed=%v\n", err)
-		return failure(t, -1, []byte(err.Error()))
+		return failure(t, reqID, -1, []byte(err.Error()))
 	}
 	defer resp.Body.Close()
 
@@ -134,9 +268,10 @@ func (t *task) execute() error {
 	if err != nil {
 		return err
 	}
+	publishRequestLog(&requestLogEntry{TaskID: t.ID, ReqID: reqID, Status: resp.StatusCode, Latency: latency, Snippet: responseSnippet(body)})
 
 	if resp.StatusCode == t.Expected {
-		if err := success(t); err != nil {
+		if err := success(t, reqID); err != nil {
 			return err
 		}
 		if t.Schedule != "" {
@@ -145,80 +280,20 @@ func (t *task) execute() error {
 		return nil
 	}
 
-	return failure(t, resp.StatusCode, body)
-}
-
-func appendTask(t *task) {
-	tasksMu.Lock()
-	defer tasksMu.Unlock()
-	tasks = append(tasks, t)
-	sort.Slice(tasks, func(i, j int) bool { return tasks[i].NextRun < tasks[j].NextRun })
+	return failure(t, reqID, resp.StatusCode, body)
 }
 
 func getNextTask() *task {
 	tasksMu.Lock()
-	defer tasksMu.Unlock()
-	if len(tasks) == 0 {
-		return nil
-	}
-	if paused {
-		return nil
-	}
-	task := tasks[0]
-	if time.Now().UnixNano() < task.NextRun {
-		return nil
-	}
-	tasks = tasks[1:]
-	return task
-}
-
-func loadTasks() error {
-	tasksMu.Lock()
-	tasks = []*task{}
-
-	waiting, err := loadDir("waiting")
-	if err != nil {
-		return err
-	}
+	isPaused := paused
 	tasksMu.Unlock()
-
-	for _, t := range waiting {
-		if t.Schedule != "" {
-			// Remove the scheduled task
-			log.Printf("dropping scheduled task %+v\n", t)
-			if err := unlinkTask(t, "waiting"); err != nil {
-				return err
-			}
-			delete(schedIdx, t.ID)
-			continue
-		}
-		appendTask(t)
-	}
-	return nil
-}
-
-func loadDir(where string) ([]*task, error) {
-	files, err := ioutil.ReadDir(filepath.Join(basePath, where))
-	if err != nil {
-		return nil, err
-	}
-	tasks := []*task{}
-	for _, f := range files {
-		content, err := ioutil.ReadFile(filepath.Join(basePath, where, f.Name()))
-		if err != nil {
-			return nil, err
-		}
-		t := &task{}
-		if err := json.Unmarshal(content, t); err != nil {
-			return nil, err
-		}
-		tasks = append(tasks, t)
+	if isPaused {
+		return nil
 	}
-
-	return tasks, nil
+	return store.Next()
 }
 
-func newTask(u string, p []byte, expected int, sched string, mdelay int) *task {
+func newTask(u string, p []byte, expected int, sched string, mdelay int, timeout int, retryPolicy RetryPolicy, signingVersion int, rateLimitKey string) *task {
 	nextRun := time.Now().Add(time.Duration(mdelay) * time.Minute)
 	tid := newID(16)
 	if sched != "" {
@@ -251,16 +326,20 @@ func newTask(u string, p []byte, expected int, sched string, mdelay int) *task {
 		Payload:          p,
 		Expected:         expected,
 		Schedule:         sched,
+		Timeout:          timeout,
+		RetryPolicy:      retryPolicy,
+		SigningVersion:   signingVersion,
+		RateLimitKey:     rateLimitKey,
 		NextRun:          nextRun.UnixNano(),
 		NextScheduledRun: nextRun.UnixNano(),
 	}
 	if t.Expected == 0 {
 		t.Expected = 200
 	}
-	if err := dumpTask(t, "waiting"); err != nil {
+	if err := store.Enqueue(t); err != nil {
 		panic(err)
 	}
-	appendTask(t)
+	publishEvent(&taskEvent{Type: eventEnqueued, TaskID: t.ID, URL: t.URL, NextRun: t.NextRun})
 	return t
 }
 
@@ -276,56 +355,69 @@ func reschedule(t *task) error {
 	t.Tries = 0
 	t.LastErrorBody = nil
 	t.LastErrorStatusCode = 0
-	if err := dumpTask(t, "waiting"); err != nil {
-		panic(err)
-	}
-	appendTask(t)
-	return nil
-}
-
-func success(t *task) error {
-	if err := unlinkTask(t, "waiting"); err != nil {
+	if err := store.Reschedule(t); err != nil {
 		return err
 	}
-	return dumpTask(t, "success")
+	publishEvent(&taskEvent{Type: eventRescheduled, TaskID: t.ID, URL: t.URL, NextRun: t.NextRun})
+	return nil
 }
 
-func dead(t *task) error {
-	if err := unlinkTask(t, "waiting"); err != nil {
+func success(t *task, reqID string) error {
+	if err := store.MarkSuccess(t); err != nil {
 		return err
 	}
-	return dumpTask(t, "dead")
-}
-
-func unlinkTask(t *task, where string) error {
-	return os.Remove(filepath.Join(basePath, where, t.ID))
+	publishEvent(&taskEvent{
+		Type:     eventSucceeded,
+		TaskID:   t.ID,
+		URL:      t.URL,
+		Tries:    t.Tries,
+		ReqID:    reqID,
+		Duration: time.Since(time.Unix(0, t.LastRun)),
+	})
+	return nil
 }
 
-func dumpTask(t *task, where string) error {
-	js, err := json.Marshal(t)
-	if err != nil {
+func dead(t *task, reqID string) error {
+	if err := store.MarkDead(t); err != nil {
 		return err
 	}
-
-	return ioutil.WriteFile(filepath.Join(basePath, where, t.ID), js, 0644)
+	publishEvent(&taskEvent{
+		Type:       eventDead,
+		TaskID:     t.ID,
+		URL:        t.URL,
+		Tries:      t.Tries,
+		ReqID:      reqID,
+		LastStatus: t.LastErrorStatusCode,
+	})
+	return nil
 }
 
-func failure(t *task, status int, serr []byte) error {
+func failure(t *task, reqID string, status int, serr []byte) error {
 	t.LastErrorStatusCode = status
 	t.LastErrorBody = serr
-	if t.Tries+1 < maxRetries {
-		t.NextRun = time.Now().Add(time.Duration(addJitter(retries[t.Tries-1])) * time.Second).UnixNano()
-		if err := dumpTask(t, "waiting"); err != nil {
+	publishEvent(&taskEvent{
+		Type:       eventFailed,
+		TaskID:     t.ID,
+		URL:        t.URL,
+		Tries:      t.Tries,
+		ReqID:      reqID,
+		LastStatus: status,
+		Duration:   time.Since(time.Unix(0, t.LastRun)),
+	})
+	policy := t.RetryPolicy.orDefault()
+	if t.Tries < policy.MaxAttempts {
+		delay := addJitter(policy.delay(t.Tries), policy.JitterFraction)
+		t.NextRun = time.Now().Add(time.Duration(delay) * time.Second).UnixNano()
+		if err := store.Enqueue(t); err != nil {
 			return err
 		}
-		appendTask(t)
-	} else {
-		return dead(t)
+		publishEvent(&taskEvent{Type: eventRetryScheduled, TaskID: t.ID, URL: t.URL, Tries: t.Tries, ReqID: reqID, NextRun: t.NextRun})
+		return nil
 	}
-	return nil
+	return dead(t, reqID)
 }
 
-func worker(stop <-chan struct{}) {
+func worker(stop <-chan struct{}, ctx context.Context) {
 	wg.Add(1)
 	defer wg.Done()
 L:
@@ -337,16 +429,8 @@ L:
 			t := getNextTask()
 			start := time.Now()
 			if t != nil {
-				r := limiter.Reserve()
-				if !r.OK() {
-					log.Println("Not allowed to act!")
-					time.Sleep(200 * time.Millisecond)
-				}
-				log.Printf("worker sleeping for %v\n", r.Delay())
-				time.Sleep(r.Delay())
-
 				t.LastRun = start.UnixNano()
-				if err := t.execute(); err != nil {
+				if err := t.execute(ctx); err != nil {
 					// TODO see what happen to the task in this case
 					log.Printf("failed to execute task: %+v: %v\n", t, err)
 				}
@@ -361,17 +445,62 @@ L:
 }
 
 func removeOldSuccess() error {
-	success, err := loadDir("success")
-	if err != nil {
-		return err
+	switch s := store.(type) {
+	case *fsStore:
+		success, err := s.List("success")
+		if err != nil {
+			return err
+		}
+		if len(success) < maxSuccess {
+			return nil
+		}
+		// Sort by last run desc
+		sort.Slice(success, func(i, j int) bool { return success[i].LastRun > success[j].LastRun })
+		for _, t := range success[maxSuccess:] {
+			if err := s.unlink(t, "success"); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *sqliteStore:
+		return s.PruneSuccess(maxSuccess)
+	default:
+		return nil
 	}
-	if len(success) < maxSuccess {
+}
+
+func reclaimStaleLeases() error {
+	s, ok := store.(*sqliteStore)
+	if !ok {
+		// The filesystem backend never removes a task's on-disk file until
+		// its outcome is known, so it has nothing equivalent to a stuck
+		// lease to reclaim.
+		return nil
+	}
+	return s.ReclaimStaleLeases()
+}
+
+// reclaimAllLeases is reclaimStaleLeases without the cutoff, for use once at
+// startup: no worker has claimed anything yet, so every row left in
+// "leased" is orphaned from the previous run, including one that was merely
+// in-flight when the process received SIGTERM. Waiting out leaseTimeout
+// before making those tasks deliverable again on every restart would make
+// shutdown's prompt in-flight cancellation pointless.
+func reclaimAllLeases() error {
+	s, ok := store.(*sqliteStore)
+	if !ok {
 		return nil
 	}
-	// Sort by last run desc
-	sort.Slice(success, func(i, j int) bool { return success[i].LastRun > success[j].LastRun })
-	for _, t := range success[maxSuccess:] {
-		if err := unlinkTask(t, "success"); err != nil {
+	return s.ReclaimAllLeases()
+}
+
+func loadTasks() error {
+	waiting, err := store.LoadWaiting()
+	if err != nil {
+		return err
+	}
+	for _, t := range waiting {
+		if err := store.Enqueue(t); err != nil {
 			return err
 		}
 	}
@@ -379,18 +508,73 @@ func removeOldSuccess() error {
 }
 
 func main() {
-	for _, where := range []string{"dead", "waiting", "success"} {
-		if err := os.MkdirAll(filepath.Join(basePath, where), 0700); err != nil {
+	switch os.Getenv("POUSSETACHES_STORE") {
+	case "sqlite":
+		if err := os.MkdirAll(basePath, 0700); err != nil {
+			panic(err)
+		}
+		dsn := os.Getenv("POUSSETACHES_SQLITE_DSN")
+		if dsn == "" {
+			dsn = filepath.Join(basePath, "poussetaches.db")
+		}
+		s, err := newSQLiteStore(dsn)
+		if err != nil {
+			panic(err)
+		}
+		store = s
+	default:
+		s, err := newFSStore(basePath)
+		if err != nil {
+			panic(err)
+		}
+		store = s
+	}
+
+	switch os.Getenv("POUSSETACHES_EVENT_SINK") {
+	case "webhook":
+		eventSink = newWebhookSink(os.Getenv("POUSSETACHES_EVENT_SINK_ADDR"))
+	case "nats":
+		topic := os.Getenv("POUSSETACHES_EVENT_SINK_TOPIC")
+		if topic == "" {
+			topic = "poussetaches.events"
+		}
+		sink, err := newNATSSink(os.Getenv("POUSSETACHES_EVENT_SINK_ADDR"), topic)
+		if err != nil {
 			panic(err)
 		}
+		eventSink = sink
+	case "kafka":
+		topic := os.Getenv("POUSSETACHES_EVENT_SINK_TOPIC")
+		if topic == "" {
+			topic = "poussetaches.events"
+		}
+		sink, err := newKafkaSink(os.Getenv("POUSSETACHES_EVENT_SINK_ADDR"), topic)
+		if err != nil {
+			panic(err)
+		}
+		eventSink = sink
 	}
+
 	if err := removeOldSuccess(); err != nil {
 		panic(err)
 	}
+	if err := reclaimAllLeases(); err != nil {
+		panic(err)
+	}
 	if err := loadTasks(); err != nil {
 		panic(err)
 	}
 
+	go func() {
+		ticker := time.NewTicker(leaseTimeout)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := reclaimStaleLeases(); err != nil {
+				log.Printf("failed to reclaim stale leases: %v\n", err)
+			}
+		}
+	}()
+
 	go func() {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			if r.Method == "GET" {
@@ -424,16 +608,37 @@ func main() {
 				}
 			}
 			log.Printf("received new task %+v\n", nt)
-			t := newTask(nt.URL, nt.Payload, nt.Expected, nt.Schedule, nt.Delay)
+			t := newTask(nt.URL, nt.Payload, nt.Expected, nt.Schedule, nt.Delay, nt.Timeout, nt.RetryPolicy, nt.SigningVersion, nt.RateLimitKey)
 			w.Header().Set("Poussetaches-Task-ID", t.ID)
 			w.WriteHeader(http.StatusCreated)
 		})
+		http.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(&map[string]interface{}{
+				"limits": limiters.snapshot(),
+			}); err != nil {
+				panic(err)
+			}
+		})
+		http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+			serveWS(eventsHub, "", w, r)
+		})
+		http.HandleFunc("/tasks/", func(w http.ResponseWriter, r *http.Request) {
+			id, ok := parseTasksLogsPath(r.URL.Path)
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			serveWS(logsHub, id, w, r)
+		})
 		http.HandleFunc("/cron", func(w http.ResponseWriter, r *http.Request) {
 			switch r.Method {
 			case "GET":
-				tasksMu.Lock()
-				defer tasksMu.Unlock()
-				tasks, err := loadDir("waiting")
+				tasks, err := store.List("waiting")
 				if err != nil {
 					panic(err)
 				}
@@ -488,14 +693,11 @@ func main() {
 						w.WriteHeader(http.StatusMethodNotAllowed)
 						return
 					}
-					tasksMu.Lock()
-					defer tasksMu.Unlock()
-					tasks, err := loadDir(where)
+					tasks, err := store.List(where)
 					if err != nil {
 						panic(err)
 					}
 
-					sort.Slice(tasks, func(i, j int) bool { return tasks[i].NextRun < tasks[j].NextRun })
 					w.Header().Set("Content-Type", "application/json")
 					if err := json.NewEncoder(w).Encode(&map[string]interface{}{
 						"tasks": tasks,
@@ -512,12 +714,11 @@ func main() {
 
 	log.Println("poussetaches starting in...")
 
-	// 3 reqs/second with a burst of 5
-	limiter = rate.NewLimiter(rate.Limit(3), 5)
-	workers := 2
+	workers := envInt("POUSSETACHES_WORKERS", 2)
 	stop := make(chan struct{}, workers)
+	ctx, cancel := context.WithCancel(context.Background())
 	for i := 0; i < workers; i++ {
-		go worker(stop)
+		go worker(stop, ctx)
 	}
 
 	// Wait until the server shut down
@@ -527,6 +728,9 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	<-cs
+	// Cancel in-flight requests before waiting for workers to drain so a slow
+	// endpoint can't pin shutdown on the OS-level TCP timeout.
+	cancel()
 	for i := 0; i < workers; i++ {
 		stop <- struct{}{}
 	}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRetryPolicyOrDefault(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3}.orDefault()
+	if p.MaxAttempts != 3 {
+		t.Fatalf("MaxAttempts = %d, want the override of 3", p.MaxAttempts)
+	}
+	if p.BaseDelay != defaultRetryPolicy.BaseDelay {
+		t.Fatalf("BaseDelay = %d, want the default %d to survive an override of an unrelated field", p.BaseDelay, defaultRetryPolicy.BaseDelay)
+	}
+	if p.Multiplier != defaultRetryPolicy.Multiplier {
+		t.Fatalf("Multiplier = %v, want the default %v to survive an override of an unrelated field", p.Multiplier, defaultRetryPolicy.Multiplier)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 1, Multiplier: 4, MaxDelay: 10}
+	if got := p.delay(1); got != 1 {
+		t.Fatalf("delay(1) = %d, want 1", got)
+	}
+	if got := p.delay(2); got != 4 {
+		t.Fatalf("delay(2) = %d, want 4", got)
+	}
+	if got := p.delay(3); got != 10 {
+		t.Fatalf("delay(3) = %d, want capped at MaxDelay 10, got %d", got, got)
+	}
+}
+
+// TestExecuteFailureInjectionSchedulesRetry exercises the debug failure
+// injection path end to end: a task whose destination would otherwise
+// succeed is forced to fail, and the retry/backoff path re-enqueues it with
+// the injected status recorded instead of burning a real upstream failure.
+func TestExecuteFailureInjectionSchedulesRetry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	fs, err := newFSStore(dir)
+	if err != nil {
+		t.Fatalf("newFSStore: %v", err)
+	}
+	store = fs
+
+	origInjection, origRate, origStatus := debugFailureInjection, debugFailureRate, debugFailureStatus
+	debugFailureInjection, debugFailureRate, debugFailureStatus = true, 1, 503
+	defer func() {
+		debugFailureInjection, debugFailureRate, debugFailureStatus = origInjection, origRate, origStatus
+	}()
+
+	task := newTask(srv.URL, nil, 200, "", 0, 0, RetryPolicy{}, 0, "")
+	if err := task.execute(context.Background()); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+
+	if task.LastErrorStatusCode != debugFailureStatus {
+		t.Fatalf("LastErrorStatusCode = %d, want the injected status %d", task.LastErrorStatusCode, debugFailureStatus)
+	}
+
+	waiting, err := fs.List("waiting")
+	if err != nil {
+		t.Fatalf("List(waiting): %v", err)
+	}
+	if len(waiting) != 1 || waiting[0].ID != task.ID {
+		t.Fatalf("waiting = %+v, want the failed task rescheduled for retry", waiting)
+	}
+}
+
+// TestExecuteFailureInjectionDeadLetters verifies a task that has exhausted
+// its retry policy is dead-lettered rather than rescheduled, even when the
+// failure was injected rather than coming from the real upstream.
+func TestExecuteFailureInjectionDeadLetters(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	fs, err := newFSStore(dir)
+	if err != nil {
+		t.Fatalf("newFSStore: %v", err)
+	}
+	store = fs
+
+	origInjection, origRate, origStatus := debugFailureInjection, debugFailureRate, debugFailureStatus
+	debugFailureInjection, debugFailureRate, debugFailureStatus = true, 1, 500
+	defer func() {
+		debugFailureInjection, debugFailureRate, debugFailureStatus = origInjection, origRate, origStatus
+	}()
+
+	task := newTask(srv.URL, nil, 200, "", 0, 0, RetryPolicy{MaxAttempts: 1}, 0, "")
+	if err := task.execute(context.Background()); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+
+	dead, err := fs.List("dead")
+	if err != nil {
+		t.Fatalf("List(dead): %v", err)
+	}
+	if len(dead) != 1 || dead[0].ID != task.ID {
+		t.Fatalf("dead = %+v, want the exhausted task dead-lettered", dead)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	defaultRateLimit = envFloat("POUSSETACHES_RATE_LIMIT", 3)
+	defaultRateBurst = envInt("POUSSETACHES_RATE_BURST", 5)
+
+	// maxLimiterDelay bounds how long getNextTask will let a throttled
+	// destination hold up the queue before it's skipped in favor of the
+	// next eligible task.
+	maxLimiterDelay = time.Duration(envInt("POUSSETACHES_MAX_LIMITER_DELAY", 5)) * time.Second
+
+	limiters = newLimiterRegistry()
+)
+
+// limiterRegistry hands out a rate.Limiter per key (by default, the
+// destination host), so a throttled or slow endpoint only ever holds back
+// its own tasks instead of every other destination.
+type limiterRegistry struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func newLimiterRegistry() *limiterRegistry {
+	return &limiterRegistry{limiters: map[string]*rate.Limiter{}}
+}
+
+func (r *limiterRegistry) get(key string) *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.limiters[key]
+	if !ok {
+		l = rate.NewLimiter(rate.Limit(defaultRateLimit), defaultRateBurst)
+		r.limiters[key] = l
+	}
+	return l
+}
+
+// snapshot reports, for every key seen so far, how many tokens are
+// currently available - for the /limits observability endpoint.
+func (r *limiterRegistry) snapshot() map[string]float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]float64, len(r.limiters))
+	for key, l := range r.limiters {
+		out[key] = l.Tokens()
+	}
+	return out
+}
+
+// rateLimitKey returns the key a task should be rate-limited under: its
+// explicit override if set, otherwise the destination URL's host.
+func rateLimitKey(t *task) string {
+	if t.RateLimitKey != "" {
+		return t.RateLimitKey
+	}
+	if u, err := url.Parse(t.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return t.URL
+}
+
+// pickEligible scans candidates in order (assumed sorted by next run) and
+// returns the first one whose rate limiter bucket isn't delayed beyond
+// maxLimiterDelay, reserving its token. A throttled destination at the head
+// of the queue is skipped in favor of the next eligible task instead of
+// stalling every other destination behind it.
+func pickEligible(candidates []*task) *task {
+	for _, t := range candidates {
+		r := limiters.get(rateLimitKey(t)).Reserve()
+		if !r.OK() {
+			continue
+		}
+		if r.Delay() > maxLimiterDelay {
+			r.Cancel()
+			continue
+		}
+		if d := r.Delay(); d > 0 {
+			time.Sleep(d)
+		}
+		return t
+	}
+	return nil
+}
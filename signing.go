@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+)
+
+// signingSecret is used to HMAC-sign outbound deliveries. Leave it unset to
+// keep relying solely on the legacy Poussetaches-Auth-Key header.
+var signingSecret = os.Getenv("POUSSETACHES_SIGNING_SECRET")
+
+// signRequest computes the HMAC-SHA256 signature a receiver can use to
+// verify a delivery came from this instance and wasn't replayed. It covers
+// the timestamp, request ID and body so none of the three can be swapped
+// out independently of the others.
+func signRequest(secret, timestamp, reqID string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte(reqID))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
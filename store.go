@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store persists tasks across the states they move through (waiting,
+// success, dead) and hands out the next task due for execution. It exists
+// so the scheduler doesn't have to know whether tasks live on disk, in an
+// embedded database or on a remote one.
+type Store interface {
+	// Enqueue persists a new or retried task in the waiting state.
+	Enqueue(t *task) error
+	// Reschedule persists a cron task that just completed its current run,
+	// with its next scheduled run already computed.
+	Reschedule(t *task) error
+	// MarkSuccess moves a task from waiting to success.
+	MarkSuccess(t *task) error
+	// MarkDead moves a task from waiting to dead.
+	MarkDead(t *task) error
+	// List returns every task currently in the given state ("waiting",
+	// "success" or "dead"), ordered by next run.
+	List(state string) ([]*task, error)
+	// LoadWaiting returns the non-scheduled tasks that were waiting when the
+	// store was last opened, for seeding the in-memory run queue at startup.
+	LoadWaiting() ([]*task, error)
+	// Next pops the next waiting task whose next run is due, skipping over
+	// tasks whose rate limiter bucket is throttled past maxLimiterDelay in
+	// favor of the next eligible one, or nil if none is ready yet.
+	Next() *task
+}
+
+// fsStore is the original persistence backend: one file per task, named
+// after its ID, under basePath/<state>/.
+type fsStore struct {
+	basePath string
+
+	mu    sync.Mutex
+	tasks []*task
+}
+
+func newFSStore(basePath string) (*fsStore, error) {
+	for _, where := range []string{"dead", "waiting", "success"} {
+		if err := os.MkdirAll(filepath.Join(basePath, where), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &fsStore{basePath: basePath}, nil
+}
+
+func (s *fsStore) dump(t *task, where string) error {
+	js, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.basePath, where, t.ID), js, 0644)
+}
+
+func (s *fsStore) unlink(t *task, where string) error {
+	return os.Remove(filepath.Join(s.basePath, where, t.ID))
+}
+
+func (s *fsStore) List(state string) ([]*task, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.basePath, state))
+	if err != nil {
+		return nil, err
+	}
+	tasks := []*task{}
+	for _, f := range files {
+		content, err := ioutil.ReadFile(filepath.Join(s.basePath, state, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		t := &task{}
+		if err := json.Unmarshal(content, t); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].NextRun < tasks[j].NextRun })
+	return tasks, nil
+}
+
+func (s *fsStore) LoadWaiting() ([]*task, error) {
+	waiting, err := s.List("waiting")
+	if err != nil {
+		return nil, err
+	}
+	kept := []*task{}
+	for _, t := range waiting {
+		if t.Schedule != "" {
+			// Cron tasks are re-registered by whatever triggers /cron, drop
+			// the stale on-disk copy instead of carrying it forward.
+			log.Printf("dropping scheduled task %+v\n", t)
+			if err := s.unlink(t, "waiting"); err != nil {
+				return nil, err
+			}
+			delete(schedIdx, t.ID)
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept, nil
+}
+
+func (s *fsStore) enqueue(t *task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = append(s.tasks, t)
+	sort.Slice(s.tasks, func(i, j int) bool { return s.tasks[i].NextRun < s.tasks[j].NextRun })
+}
+
+func (s *fsStore) Enqueue(t *task) error {
+	if err := s.dump(t, "waiting"); err != nil {
+		return err
+	}
+	s.enqueue(t)
+	return nil
+}
+
+func (s *fsStore) Reschedule(t *task) error {
+	return s.Enqueue(t)
+}
+
+func (s *fsStore) MarkSuccess(t *task) error {
+	if err := s.unlink(t, "waiting"); err != nil {
+		return err
+	}
+	return s.dump(t, "success")
+}
+
+func (s *fsStore) MarkDead(t *task) error {
+	if err := s.unlink(t, "waiting"); err != nil {
+		return err
+	}
+	return s.dump(t, "dead")
+}
+
+func (s *fsStore) Next() *task {
+	s.mu.Lock()
+	now := time.Now().UnixNano()
+	due := []*task{}
+	for _, t := range s.tasks {
+		if t.NextRun > now {
+			break
+		}
+		due = append(due, t)
+	}
+	s.mu.Unlock()
+
+	// pickEligible can sleep out a rate-limit delay; do that with the lock
+	// released so a throttled destination only holds up its own call to
+	// Next(), not every other worker's.
+	t := pickEligible(due)
+	if t == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, c := range s.tasks {
+		if c == t {
+			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+			return t
+		}
+	}
+	// Another worker already claimed it while we were reserving/sleeping.
+	return nil
+}
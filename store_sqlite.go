@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore is a Store backend on top of an embedded SQLite database,
+// opened through the go-sqlite3 driver from a local DSN; it does not
+// connect to a remote rqlite cluster. It keeps a single tasks table
+// indexed on (state, next_run) so picking the next due task is a bounded
+// query instead of loading and sorting every task in memory.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(dsn string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`
+CREATE TABLE IF NOT EXISTS tasks (
+	id                     TEXT PRIMARY KEY,
+	state                  TEXT NOT NULL,
+	next_run               INTEGER NOT NULL,
+	next_scheduled_run     INTEGER NOT NULL,
+	tries                  INTEGER NOT NULL,
+	url                    TEXT NOT NULL,
+	payload                BLOB,
+	expected               INTEGER NOT NULL,
+	schedule               TEXT NOT NULL,
+	timeout                INTEGER NOT NULL,
+	last_run               INTEGER NOT NULL,
+	last_error_body        BLOB,
+	last_error_status_code INTEGER NOT NULL,
+	leased_at              INTEGER NOT NULL DEFAULT 0,
+	retry_policy           TEXT NOT NULL DEFAULT '{}',
+	signing_version        INTEGER NOT NULL DEFAULT 0,
+	rate_limit_key         TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_tasks_state_next_run ON tasks (state, next_run);
+`); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) put(t *task, state string) error {
+	retryPolicy, err := json.Marshal(t.RetryPolicy)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+INSERT INTO tasks (id, state, next_run, next_scheduled_run, tries, url, payload, expected, schedule, timeout, last_run, last_error_body, last_error_status_code, retry_policy, signing_version, rate_limit_key)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET
+	state = excluded.state,
+	next_run = excluded.next_run,
+	next_scheduled_run = excluded.next_scheduled_run,
+	tries = excluded.tries,
+	last_run = excluded.last_run,
+	last_error_body = excluded.last_error_body,
+	last_error_status_code = excluded.last_error_status_code,
+	retry_policy = excluded.retry_policy,
+	signing_version = excluded.signing_version,
+	rate_limit_key = excluded.rate_limit_key,
+	leased_at = 0
+`, t.ID, state, t.NextRun, t.NextScheduledRun, t.Tries, t.URL, t.Payload, t.Expected, t.Schedule, t.Timeout, t.LastRun, t.LastErrorBody, t.LastErrorStatusCode, retryPolicy, t.SigningVersion, t.RateLimitKey)
+	return err
+}
+
+func (s *sqliteStore) Enqueue(t *task) error {
+	return s.put(t, "waiting")
+}
+
+func (s *sqliteStore) Reschedule(t *task) error {
+	return s.put(t, "waiting")
+}
+
+func (s *sqliteStore) MarkSuccess(t *task) error {
+	return s.put(t, "success")
+}
+
+func (s *sqliteStore) MarkDead(t *task) error {
+	return s.put(t, "dead")
+}
+
+const taskColumns = "id, next_run, next_scheduled_run, tries, url, payload, expected, schedule, timeout, last_run, last_error_body, last_error_status_code, retry_policy, signing_version, rate_limit_key"
+
+func (s *sqliteStore) scan(rows *sql.Rows) ([]*task, error) {
+	tasks := []*task{}
+	for rows.Next() {
+		t := &task{}
+		var retryPolicy []byte
+		if err := rows.Scan(&t.ID, &t.NextRun, &t.NextScheduledRun, &t.Tries, &t.URL, &t.Payload, &t.Expected, &t.Schedule, &t.Timeout, &t.LastRun, &t.LastErrorBody, &t.LastErrorStatusCode, &retryPolicy, &t.SigningVersion, &t.RateLimitKey); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(retryPolicy, &t.RetryPolicy); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+func (s *sqliteStore) List(state string) ([]*task, error) {
+	rows, err := s.db.Query(`
+SELECT `+taskColumns+`
+FROM tasks WHERE state = ? ORDER BY next_run`, state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.scan(rows)
+}
+
+func (s *sqliteStore) LoadWaiting() ([]*task, error) {
+	rows, err := s.db.Query(`
+SELECT ` + taskColumns + `
+FROM tasks WHERE state = 'waiting' AND schedule = '' ORDER BY next_run`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.scan(rows)
+}
+
+// maxNextCandidates bounds how many due tasks Next() pulls in one query
+// before picking the first one whose rate limiter isn't throttled; it keeps
+// each query a bounded scan of the (state, next_run) index rather than a
+// full table scan even when a destination is heavily backed up.
+const maxNextCandidates = 50
+
+// maxNextScanned bounds the total number of waiting rows a single Next()
+// call will page through across batches. Without this, a host with >=
+// maxNextCandidates backlogged tasks would exhaust the first (and only)
+// batch on its own throttled candidates and return nil even though an idle
+// host's tasks are sitting right behind them in the table - reintroducing
+// the single-host-starves-everyone-else bug per-URL/host rate limiting
+// exists to fix. Paging continues past one batch until this cap is hit.
+const maxNextScanned = 1000
+
+func (s *sqliteStore) Next() *task {
+	now := time.Now().UnixNano()
+	var afterNextRun int64
+	var afterID string
+	hasCursor := false
+
+	for scanned := 0; scanned < maxNextScanned; {
+		batch, err := s.nextCandidates(now, hasCursor, afterNextRun, afterID, maxNextCandidates)
+		if err != nil {
+			log.Printf("sqlite: failed to query next tasks: %v\n", err)
+			return nil
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		scanned += len(batch)
+		last := batch[len(batch)-1]
+		afterNextRun, afterID, hasCursor = last.NextRun, last.ID, true
+
+		candidates := batch
+		for len(candidates) > 0 {
+			t := pickEligible(candidates)
+			if t == nil {
+				// Nothing in this batch is eligible right now; page forward
+				// to the next maxNextCandidates due tasks instead of giving
+				// up on the whole poll.
+				break
+			}
+
+			claimed, err := s.claim(t)
+			if err != nil {
+				log.Printf("sqlite: failed to lease task %s: %v\n", t.ID, err)
+				return nil
+			}
+			if claimed {
+				return t
+			}
+			// Another worker's claim landed first between our SELECT and this
+			// UPDATE; drop it and try the next eligible candidate from this
+			// batch instead of handing out the same task twice.
+			candidates = dropTask(candidates, t)
+		}
+	}
+	return nil
+}
+
+// nextCandidates fetches up to limit waiting tasks due by now, ordered by
+// (next_run, id), resuming after the given cursor when hasCursor is set so
+// repeated calls page forward through the backlog instead of refetching the
+// same head of the queue.
+func (s *sqliteStore) nextCandidates(now int64, hasCursor bool, afterNextRun int64, afterID string, limit int) ([]*task, error) {
+	var rows *sql.Rows
+	var err error
+	if hasCursor {
+		rows, err = s.db.Query(`
+SELECT `+taskColumns+`
+FROM tasks WHERE state = 'waiting' AND next_run <= ? AND (next_run > ? OR (next_run = ? AND id > ?))
+ORDER BY next_run, id LIMIT ?`, now, afterNextRun, afterNextRun, afterID, limit)
+	} else {
+		rows, err = s.db.Query(`
+SELECT `+taskColumns+`
+FROM tasks WHERE state = 'waiting' AND next_run <= ?
+ORDER BY next_run, id LIMIT ?`, now, limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return s.scan(rows)
+}
+
+// claim atomically moves a task from waiting to leased, reporting whether
+// this call won the race (false means another worker claimed it first).
+func (s *sqliteStore) claim(t *task) (bool, error) {
+	res, err := s.db.Exec(`UPDATE tasks SET state = 'leased', leased_at = ? WHERE id = ? AND state = 'waiting'`, time.Now().UnixNano(), t.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func dropTask(tasks []*task, t *task) []*task {
+	out := tasks[:0]
+	for _, c := range tasks {
+		if c != t {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// PruneSuccess deletes success rows beyond the most recent max (by
+// last_run), keeping the success table bounded the same way the flat-file
+// backend's maxSuccess cap does.
+func (s *sqliteStore) PruneSuccess(max int) error {
+	_, err := s.db.Exec(`
+DELETE FROM tasks WHERE state = 'success' AND id NOT IN (
+	SELECT id FROM tasks WHERE state = 'success' ORDER BY last_run DESC LIMIT ?
+)`, max)
+	return err
+}
+
+// leaseTimeout bounds how long a task may stay leased before
+// ReclaimStaleLeases considers its worker dead and puts it back in waiting.
+var leaseTimeout = time.Duration(envInt("POUSSETACHES_LEASE_TIMEOUT", 300)) * time.Second
+
+// ReclaimStaleLeases moves tasks stuck in the leased state back to waiting
+// once their lease is older than leaseTimeout. Nothing else ever reads or
+// resets "leased", so a worker that dies between claiming a task and
+// recording its outcome would otherwise strand it forever - invisible on
+// /waiting, /dead and /success alike.
+func (s *sqliteStore) ReclaimStaleLeases() error {
+	cutoff := time.Now().Add(-leaseTimeout).UnixNano()
+	_, err := s.db.Exec(`UPDATE tasks SET state = 'waiting', leased_at = 0 WHERE state = 'leased' AND leased_at <= ?`, cutoff)
+	return err
+}
+
+// ReclaimAllLeases moves every leased task back to waiting regardless of how
+// recently it was claimed. At startup no worker has claimed anything yet, so
+// every row still in "leased" is guaranteed orphaned by the previous run -
+// unlike the periodic reclaim, there's no live worker a cutoff needs to
+// protect.
+func (s *sqliteStore) ReclaimAllLeases() error {
+	_, err := s.db.Exec(`UPDATE tasks SET state = 'waiting', leased_at = 0 WHERE state = 'leased'`)
+	return err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	eventsHub = newHub()
+	logsHub   = newHub()
+
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     func(r *http.Request) bool { return true },
+	}
+)
+
+// requestLogEntry describes a single outbound delivery attempt, streamed to
+// whoever is watching a task's logs over /tasks/{id}/logs.
+type requestLogEntry struct {
+	Time    int64         `json:"time"`
+	TaskID  string        `json:"task_id"`
+	ReqID   string        `json:"req_id"`
+	Status  int           `json:"status"`
+	Latency time.Duration `json:"latency"`
+	Snippet string        `json:"response_snippet,omitempty"`
+	Err     string        `json:"error,omitempty"`
+}
+
+// responseSnippet trims a response body down to something safe to stream
+// and log, rather than forwarding arbitrarily large payloads.
+const responseSnippetLen = 256
+
+func responseSnippet(body []byte) string {
+	if len(body) > responseSnippetLen {
+		return string(body[:responseSnippetLen])
+	}
+	return string(body)
+}
+
+func publishRequestLog(entry *requestLogEntry) {
+	entry.Time = time.Now().UnixNano()
+	js, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("ws: failed to marshal request log: %v\n", err)
+		return
+	}
+	logsHub.broadcast(entry.TaskID, js)
+}
+
+// subscriber is one connected websocket client. taskID, when set, restricts
+// the feed to events/logs about that task only.
+type subscriber struct {
+	ch     chan []byte
+	taskID string
+}
+
+// hub fans out broadcast messages to subscribers. Each subscriber gets a
+// bounded buffer; a client that can't keep up is disconnected instead of
+// slowing down every other consumer or the publisher.
+type hub struct {
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+func newHub() *hub {
+	return &hub{subs: map[*subscriber]struct{}{}}
+}
+
+func (h *hub) subscribe(taskID string) *subscriber {
+	s := &subscriber{ch: make(chan []byte, 32), taskID: taskID}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+	h.mu.Unlock()
+}
+
+func (h *hub) broadcast(taskID string, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if s.taskID != "" && s.taskID != taskID {
+			continue
+		}
+		select {
+		case s.ch <- msg:
+		default:
+			log.Println("ws: disconnecting slow consumer")
+			delete(h.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+func serveWS(h *hub, taskID string, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("ws: upgrade failed: %v\n", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := h.subscribe(taskID)
+	defer h.unsubscribe(sub)
+
+	// Gorilla only processes control frames (ping/close) while something is
+	// reading the connection. This client never sends data, so just discard
+	// whatever comes in and use a read error to detect it going away -
+	// otherwise a subscriber on a quiet task would never be unsubscribed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseTasksLogsPath extracts the task ID from a "/tasks/{id}/logs" path.
+func parseTasksLogsPath(p string) (string, bool) {
+	const prefix = "/tasks/"
+	const suffix = "/logs"
+	if !strings.HasPrefix(p, prefix) || !strings.HasSuffix(p, suffix) {
+		return "", false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(p, prefix), suffix)
+	if id == "" {
+		return "", false
+	}
+	return id, true
+}